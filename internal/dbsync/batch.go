@@ -0,0 +1,226 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Rows of one table that share the same column set
+type batchGroup struct {
+	tableName string
+	columns   []string
+	rows      [][]interface{}
+}
+
+// UpsertBatch writes the entities as multi-row upserts. The entities are grouped
+// by table and column set, every group is written with as few statements as
+// the parameter limit of the dialect allows.
+func (con *DBConnection) UpsertBatch(entities []Entity) error {
+
+	if err := con.discoverColumns(entities); err != nil {
+		return err
+	}
+
+	for _, group := range con.groupEntities(entities) {
+		if err := con.upsertGroup(group); err != nil {
+			return err
+		}
+	}
+	return con.appendHistories(con.DB, entities)
+}
+
+// BulkUpsert writes the entities through the bulk load path of the dialect
+// (e.g. COPY on Postgres): one staging load and one merge per table, all in a
+// single database transaction. Dialects without bulk support fall back to UpsertBatch.
+func (con *DBConnection) BulkUpsert(entities []Entity) error {
+
+	var loader, ok = con.Dialect.(BulkLoader)
+	if !ok {
+		return con.UpsertBatch(entities)
+	}
+
+	if err := con.discoverColumns(entities); err != nil {
+		return err
+	}
+
+	tx, err := con.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range con.tableGroups(entities) {
+		if err = loader.BulkUpsert(tx, group.tableName, group.columns, group.rows); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = con.appendHistories(tx, entities); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Only one occurrence of an entity is written: a row must not be affected twice
+// by the same statement, and an older version of a contact must not overwrite the
+// newer one. Contacts fetched concurrently arrive in any order, the highest $version
+// wins; otherwise (and for equal versions) the last occurrence.
+func latestEntities(entities []Entity) []Entity {
+
+	var chosen = map[string]int{}
+	for i, entity := range entities {
+
+		var key = entity.Type + "|" + fmt.Sprint((*entity.Data)["$id"])
+		if j, ok := chosen[key]; ok && entity.Type == "contact" &&
+			newerVersion(fmt.Sprint((*entities[j].Data)["$version"]), fmt.Sprint((*entity.Data)["$version"])) {
+			continue
+		}
+		chosen[key] = i
+	}
+
+	var latest = make([]Entity, 0, len(chosen))
+	for i, entity := range entities {
+		if chosen[entity.Type+"|"+fmt.Sprint((*entity.Data)["$id"])] == i {
+			latest = append(latest, entity)
+		}
+	}
+	return latest
+}
+
+func (con *DBConnection) groupEntities(entities []Entity) []*batchGroup {
+
+	var groups []*batchGroup
+	var groupsByKey = map[string]*batchGroup{}
+
+	for _, entity := range latestEntities(entities) {
+
+		if con.Mapping[entity.Type].Exclude {
+			continue
+		}
+
+		var tableName = con.qualify(con.tableName(entity.Type))
+		var fieldNames, values = con.row(entity)
+
+		var key = tableName + "|" + strings.Join(fieldNames, "|")
+		var group = groupsByKey[key]
+		if group == nil {
+			group = &batchGroup{
+				tableName: tableName,
+				columns:   fieldNames,
+			}
+			groupsByKey[key] = group
+			groups = append(groups, group)
+		}
+		group.rows = append(group.rows, values)
+	}
+
+	return groups
+}
+
+// One group per table (parents before their children): the rows are normalised to
+// the columns of all rows of the table, missing values are NULL
+func (con *DBConnection) tableGroups(entities []Entity) []*batchGroup {
+
+	var groupsByTable = map[string]*batchGroup{}
+	var columnSets = map[string]map[string]bool{}
+	var data = map[string][]map[string]interface{}{}
+
+	for _, entity := range latestEntities(entities) {
+
+		if con.Mapping[entity.Type].Exclude {
+			continue
+		}
+
+		var tableName = con.qualify(con.tableName(entity.Type))
+		var fieldNames, values = con.row(entity)
+
+		if groupsByTable[entity.Type] == nil {
+			groupsByTable[entity.Type] = &batchGroup{tableName: tableName}
+			columnSets[entity.Type] = map[string]bool{}
+		}
+
+		var row = make(map[string]interface{}, len(fieldNames))
+		for i, name := range fieldNames {
+			row[name] = values[i]
+			columnSets[entity.Type][name] = true
+		}
+		data[entity.Type] = append(data[entity.Type], row)
+	}
+
+	var groups []*batchGroup
+	for _, entityType := range entityTypes {
+
+		var group = groupsByTable[entityType]
+		if group == nil {
+			continue
+		}
+
+		for name := range columnSets[entityType] {
+			group.columns = append(group.columns, name)
+		}
+		sort.Strings(group.columns)
+
+		for _, row := range data[entityType] {
+			var values = make([]interface{}, len(group.columns))
+			for i, name := range group.columns {
+				values[i] = row[name]
+			}
+			group.rows = append(group.rows, values)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func (con *DBConnection) upsertGroup(group *batchGroup) error {
+
+	var chunkSize = con.Dialect.MaxParams() / len(group.columns)
+
+	// A single row exceeds the parameter limit (e.g. MaxFields set beyond it)
+	if chunkSize < 1 {
+		return con.upsertRows(group)
+	}
+
+	for start := 0; start < len(group.rows); start += chunkSize {
+
+		var end = start + chunkSize
+		if end > len(group.rows) {
+			end = len(group.rows)
+		}
+
+		var b bytes.Buffer
+		con.Dialect.PrepareBatchUpsert(group.tableName, group.columns, end-start, &b)
+
+		var values = make([]interface{}, 0, (end-start)*len(group.columns))
+		for _, row := range group.rows[start:end] {
+			values = append(values, row...)
+		}
+
+		if _, err := con.DB.Exec(b.String(), values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the rows of the group one by one
+func (con *DBConnection) upsertRows(group *batchGroup) error {
+
+	var idIndex int
+	for i, name := range group.columns {
+		if name == "$id" {
+			idIndex = i
+		}
+	}
+
+	for _, row := range group.rows {
+		if err := con.upsertRow(con.DB, group.tableName, group.columns, row, row[idIndex]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
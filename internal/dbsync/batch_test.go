@@ -0,0 +1,141 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpsertBatchVersions(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		versions []string // $versions of contact "a" in batch order
+		stored   string   // $version in the contacts table
+		open     string   // $version of the open history row
+	}{
+		{"ascending", []string{"1", "2"}, "2", "2"},
+		{"descending", []string{"2", "1"}, "2", "2"},
+		{"unordered", []string{"3", "10", "2"}, "10", "10"},
+		{"repeated", []string{"2", "2"}, "2", "2"},
+		{"single", []string{"7"}, "7", "7"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var con = openTestDB(t, map[string]string{"Name": "text"}, func(con *DBConnection) { con.History = true })
+
+			var entities []Entity
+			for _, version := range test.versions {
+				entities = append(entities, testContact("a", version, map[string]interface{}{"Name": "v" + version}))
+			}
+
+			if err := con.UpsertBatch(entities); err != nil {
+				t.Fatal(err)
+			}
+
+			if version := queryString(t, con, `SELECT "$version" FROM df_contacts WHERE "$id" = 'a'`); version != test.stored {
+				t.Errorf("got contact version %v, want %v", version, test.stored)
+			}
+			if name := queryString(t, con, `SELECT "Name" FROM df_contacts WHERE "$id" = 'a'`); name != "v"+test.stored {
+				t.Errorf("got contact field %v, want %v", name, "v"+test.stored)
+			}
+			if version := queryString(t, con, `SELECT "$version" FROM df_contacts_history WHERE "$contact_id" = 'a' AND "$valid_to" IS NULL`); version != test.open {
+				t.Errorf("got open history version %v, want %v", version, test.open)
+			}
+		})
+	}
+}
+
+func TestTableGroups(t *testing.T) {
+
+	var con = openTestDB(t, map[string]string{"Name": "text", "Age": "number"}, nil)
+
+	var transaction = map[string]interface{}{"$id": "t1", "$contact_id": "a", "type": "call"}
+	var entities = []Entity{
+		{Type: "transaction", Data: &transaction},
+		testContact("a", "1", map[string]interface{}{"Name": "x"}),
+		testContact("b", "2", map[string]interface{}{"Age": "3"}),
+		testContact("a", "3", map[string]interface{}{"Name": "y", "Age": ""}),
+	}
+
+	var want = []batchGroup{
+		{
+			tableName: "df_contacts",
+			columns:   []string{"$campaign_id", "$id", "$version", "Age", "Name"},
+			rows: [][]interface{}{
+				{testCampaignID, "b", "2", int64(3), nil},
+				{testCampaignID, "a", "3", nil, "y"},
+			},
+		},
+		{
+			tableName: "df_transactions",
+			columns:   []string{"$contact_id", "$id", "type"},
+			rows:      [][]interface{}{{"a", "t1", "call"}},
+		},
+	}
+
+	var groups = con.tableGroups(entities)
+	if len(groups) != len(want) {
+		t.Fatalf("got %v groups, want %v", len(groups), len(want))
+	}
+
+	for i, group := range groups {
+		if !reflect.DeepEqual(*group, want[i]) {
+			t.Errorf("got group %+v, want %+v", *group, want[i])
+		}
+	}
+}
+
+func TestUpsertBatchWideContacts(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		maxFields int    // 0 = limit of the dialect
+		extra     string // Field expected in $extra, "" = all fields in columns
+	}{
+		{"limit of the dialect", 0, "F0999"},
+		{"beyond the parameter limit", 1000, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var fields = map[string]string{}
+			var values = map[string]interface{}{}
+			for i := 0; i < 1000; i++ {
+				var name = fmt.Sprintf("F%04d", i)
+				fields[name] = "text"
+				values[name] = "v" + name
+			}
+
+			var con = openTestDB(t, fields, func(con *DBConnection) { con.MaxFields = test.maxFields })
+
+			var entities = []Entity{testContact("a", "1", values), testContact("b", "1", values)}
+			if err := con.UpsertBatch(entities); err != nil {
+				t.Fatal(err)
+			}
+
+			if count := queryString(t, con, "SELECT COUNT(*) FROM df_contacts"); count != "2" {
+				t.Errorf("got %v contacts, want 2", count)
+			}
+			if value := queryString(t, con, `SELECT "F0000" FROM df_contacts WHERE "$id" = 'b'`); value != "vF0000" {
+				t.Errorf("got %q, want %q", value, "vF0000")
+			}
+
+			if test.extra == "" {
+				if value := queryString(t, con, `SELECT "F0999" FROM df_contacts WHERE "$id" = 'b'`); value != "vF0999" {
+					t.Errorf("got %q, want %q", value, "vF0999")
+				}
+				return
+			}
+
+			var extra = queryString(t, con, `SELECT "$extra" FROM df_contacts WHERE "$id" = 'b'`)
+			if !strings.Contains(extra, `"`+test.extra+`":"v`+test.extra+`"`) {
+				t.Errorf("got $extra %q, want field %q", extra, test.extra)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Parent-id columns referencing the $id of the parent entity
+var tableRelations = map[string]struct {
+	Column string
+	Parent string
+}{
+	"task_log":    {"$contact_id", "contact"},
+	"transaction": {"$contact_id", "contact"},
+	"connection":  {"$transaction_id", "transaction"},
+	"recording":   {"$connection_id", "connection"},
+}
+
+// Columns used by reporting joins and time range queries
+var tableIndexes = map[string][]string{
+	"task_log":    {"$contact_id", "$first_fired"},
+	"transaction": {"$contact_id", "$task_log_id", "fired", "started"},
+	"connection":  {"$transaction_id", "fired", "started"},
+	"recording":   {"$connection_id", "started"},
+}
+
+// Creates the missing indexes and foreign keys (iff enabled)
+func (con *DBConnection) updateConstraints() error {
+
+	for _, entityType := range con.syncedTypes() {
+
+		var relation, hasParent = tableRelations[entityType]
+		var columns []string
+		for _, field := range tableIndexes[entityType] {
+			if column := con.columnName(entityType, field); column != "" {
+				columns = append(columns, column)
+			}
+		}
+		if con.SharedTables {
+			columns = append(columns, "$campaign_id")
+		}
+
+		if !(con.ForeignKeys && hasParent) && !(con.Indexes && len(columns) > 0) {
+			continue
+		}
+
+		var table = con.tableName(entityType)
+		var existing = con.getTableConstraints(table)
+
+		// Foreign keys first, the column type has to be aligned before the column gets indexed
+		if con.ForeignKeys && hasParent {
+			var name = constraintName("fk", table, relation.Column)
+			if !existing[strings.ToLower(name)] {
+
+				if err := con.alignParentColumn(table, relation.Column, con.tableName(relation.Parent)); err != nil {
+					return err
+				}
+
+				var b bytes.Buffer
+				con.Dialect.AddForeignKey(con.qualify(table), name, relation.Column, con.qualify(con.tableName(relation.Parent)), &b)
+				if b.Len() == 0 {
+					errorLog.Printf("Foreign keys are not supported by %v, %v skipped\n", con.DBType, name)
+				} else if err := con.exec(b.String()); err != nil {
+					return err
+				}
+			}
+		}
+
+		if con.Indexes {
+			for _, column := range columns {
+
+				var name = constraintName("idx", table, column)
+				if existing[strings.ToLower(name)] {
+					continue
+				}
+
+				var b bytes.Buffer
+				con.Dialect.CreateIndex(con.qualify(table), name, column, &b)
+				if err := con.exec(b.String()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Versions of a contact
+	if con.History && con.Indexes {
+
+		var table = con.historyTable()
+		var name = constraintName("idx", table, "$contact_id")
+		if !con.getTableConstraints(table)[strings.ToLower(name)] {
+
+			var b bytes.Buffer
+			con.Dialect.CreateIndex(con.qualify(table), name, "$contact_id", &b)
+			if err := con.exec(b.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Converts a parent-id column to the type of the $id it references: parent-id
+// columns of older tables are strings (e.g. nvarchar(255)), SQL Server only
+// accepts foreign keys between columns of the same type. Fails on SQL Server
+// if the column is already indexed.
+func (con *DBConnection) alignParentColumn(tableName string, column string, parentTable string) error {
+
+	var currentType = con.getTableColumns(tableName)[column]
+	var parentType = con.getTableColumns(parentTable)["$id"]
+	if currentType == "" || strings.EqualFold(currentType, parentType) {
+		return nil
+	}
+
+	var stmts = con.Dialect.AlterColumnType(con.qualify(tableName), column, currentType, con.toDBType("id"))
+	if len(stmts) > 0 {
+		debugLog.Printf("Change column type %v.%v: %v --> %v", tableName, column, currentType, parentType)
+	}
+	for _, stmt := range stmts {
+		if err := con.exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names of all indexes and constraints of a table (lower case)
+func (con *DBConnection) getTableConstraints(tableName string) map[string]bool {
+
+	var stmt = con.Dialect.TableConstraintsQuery(con.Schema, tableName)
+
+	var names = map[string]bool{}
+	rows, err := con.DB.Query(stmt)
+	if err != nil {
+		errorLog.Printf("%v\n", stmt)
+		errorLog.Printf("%v \n", err.Error())
+		return names
+	}
+
+	defer rows.Close()
+
+	var name string
+	for rows.Next() {
+		rows.Scan(&name)
+		names[strings.ToLower(name)] = true
+	}
+
+	return names
+}
+
+// e.g. idx_df_transactions_contact_id
+func constraintName(prefix string, tableName string, column string) string {
+	return prefix + "_" + tableName + "_" + strings.Trim(column, "$")
+}
@@ -0,0 +1,363 @@
+package database
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entities that could not be written, kept until they are replayed, e.g. "df_dead_letters"
+func (con *DBConnection) deadLettersTable() string {
+	return strings.ToLower(con.TablePrefix) + "dead_letters"
+}
+
+var deadLettersSchema = []map[string]string{
+	{"$id": "string"},
+	{"campaign_id": "string"},
+	{"entity_type": "string"},
+	{"entity_id": "string"},
+	{"parent_id": "string"},
+	{"data": "json"}, // text is limited to 64 KB on MySQL
+	{"error": "text"},
+	{"attempts": "int"},
+	{"failed_at": "timestamp"},
+}
+
+// $ids of the stored dead letters of the campaign, written entities only delete
+// the dead letters known to exist
+type deadLetterSet struct {
+	sync.Mutex
+	ids map[string]bool // nil: not loaded, every removal is executed
+}
+
+// Entity whose upsert failed
+type DeadLetter struct {
+	Entity   Entity
+	Error    string // Last error
+	Attempts int    // Number of failed upserts
+}
+
+// One dead letter per campaign and entity
+func (con *DBConnection) deadLetterID(entity Entity) string {
+	var sum = md5.Sum([]byte(con.CampaignID + "|" + entity.Type + "|" + fmt.Sprint((*entity.Data)["$id"])))
+	return hex.EncodeToString(sum[:])
+}
+
+// Line of the dead letter file (see DeadLetterFile)
+type deadLetterLine struct {
+	EntityType string                  `json:"entity_type"`
+	Data       *map[string]interface{} `json:"data"`
+	Error      string                  `json:"error"`
+	FailedAt   time.Time               `json:"failed_at"`
+}
+
+// Serialises the appends and imports of the dead letter files
+var deadLetterFileMu sync.Mutex
+
+// StoreDeadLetter keeps an entity whose upsert failed, the attempts of an entity
+// that failed before are counted up. If the dead letter cannot be stored in the
+// database (e.g. during an outage), it is appended to DeadLetterFile and moved
+// into the table by the next replay.
+func (con *DBConnection) StoreDeadLetter(entity Entity, cause error) error {
+
+	var err = con.storeDeadLetter(entity, cause.Error(), time.Now().UTC())
+	if err == nil || con.DeadLetterFile == "" {
+		return err
+	}
+
+	errorLog.Printf("Dead letter of %v %v written to %v | %v\n", entity.Type, (*entity.Data)["$id"], con.DeadLetterFile, err.Error())
+	return appendDeadLetterFile(con.DeadLetterFile, deadLetterLine{
+		EntityType: entity.Type,
+		Data:       entity.Data,
+		Error:      cause.Error(),
+		FailedAt:   time.Now().UTC(),
+	})
+}
+
+func appendDeadLetterFile(filePath string, line deadLetterLine) error {
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	deadLetterFileMu.Lock()
+	defer deadLetterFileMu.Unlock()
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Moves the dead letters of DeadLetterFile into the table, lines that cannot be stored are kept
+func (con *DBConnection) importDeadLetterFile() error {
+
+	deadLetterFileMu.Lock()
+	defer deadLetterFileMu.Unlock()
+
+	data, err := ioutil.ReadFile(con.DeadLetterFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept [][]byte
+	var storeErr error
+	for _, line := range bytes.Split(data, []byte("\n")) {
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		// Numbers as json.Number, as delivered by the Dialfire API
+		var letter deadLetterLine
+		var dec = json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err = dec.Decode(&letter); err != nil {
+			return errors.New(con.DeadLetterFile + ": " + err.Error())
+		}
+
+		if err = con.storeDeadLetter(Entity{Type: letter.EntityType, Data: letter.Data}, letter.Error, letter.FailedAt); err != nil {
+			kept = append(kept, line)
+			storeErr = err
+		}
+	}
+
+	if len(kept) == 0 {
+		return os.Remove(con.DeadLetterFile)
+	}
+
+	if err = ioutil.WriteFile(con.DeadLetterFile, append(bytes.Join(kept, []byte("\n")), '\n'), 0644); err != nil {
+		return err
+	}
+	return storeErr
+}
+
+func (con *DBConnection) storeDeadLetter(entity Entity, errText string, failedAt time.Time) error {
+
+	data, err := json.Marshal(entity.Data)
+	if err != nil {
+		return err
+	}
+
+	var id = con.deadLetterID(entity)
+	var tableName = con.qualify(con.deadLettersTable())
+
+	var attempts int
+	var stmt = "SELECT " + con.Dialect.Quote("attempts") + " FROM " + tableName + " WHERE " + con.Dialect.Quote("$id") + " = " + con.Dialect.Placeholder(1)
+	rows, err := con.DB.Query(stmt, id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		if err = rows.Scan(&attempts); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+
+	var parentID string
+	if relation, hasParent := tableRelations[entity.Type]; hasParent {
+		parentID = fmt.Sprint((*entity.Data)[relation.Column])
+	}
+
+	var fieldNames = []string{"$id", "attempts", "campaign_id", "data", "entity_id", "entity_type", "error", "failed_at", "parent_id"}
+	var values = []interface{}{
+		id,
+		attempts + 1,
+		con.CampaignID,
+		con.Dialect.JSONArg(data),
+		fmt.Sprint((*entity.Data)["$id"]),
+		entity.Type,
+		errText,
+		failedAt,
+		parentID,
+	}
+
+	if err = con.upsertRow(con.DB, tableName, fieldNames, values, id); err != nil {
+		return err
+	}
+
+	con.deadLetters.Lock()
+	if con.deadLetters.ids != nil {
+		con.deadLetters.ids[id] = true
+	}
+	con.deadLetters.Unlock()
+	return nil
+}
+
+// Reads the $ids of the stored dead letters of the campaign
+func (con *DBConnection) loadDeadLetters() error {
+
+	var q = con.Dialect.Quote
+	var stmt = "SELECT " + q("$id") + " FROM " + con.qualify(con.deadLettersTable()) + " WHERE " + q("campaign_id") + " = " + con.Dialect.Placeholder(1)
+
+	rows, err := con.DB.Query(stmt, con.CampaignID)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var ids = map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return err
+		}
+		ids[id] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	con.deadLetters.Lock()
+	con.deadLetters.ids = ids
+	con.deadLetters.Unlock()
+	return nil
+}
+
+// DeadLetters returns the dead letters of the campaign, parents before their children.
+// The dead letters of DeadLetterFile are moved into the table first.
+func (con *DBConnection) DeadLetters() ([]DeadLetter, error) {
+
+	if con.DeadLetterFile != "" {
+		if err := con.importDeadLetterFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	var q = con.Dialect.Quote
+	var stmt = "SELECT " + q("entity_type") + ", " + q("data") + ", " + q("error") + ", " + q("attempts") +
+		" FROM " + con.qualify(con.deadLettersTable()) + " WHERE " + q("campaign_id") + " = " + con.Dialect.Placeholder(1)
+
+	rows, err := con.DB.Query(stmt, con.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+
+		var letter DeadLetter
+		var data string
+		if err = rows.Scan(&letter.Entity.Type, &data, &letter.Error, &letter.Attempts); err != nil {
+			return nil, err
+		}
+
+		// Numbers as json.Number, as delivered by the Dialfire API
+		var entityData map[string]interface{}
+		var dec = json.NewDecoder(bytes.NewReader([]byte(data)))
+		dec.UseNumber()
+		if err = dec.Decode(&entityData); err != nil {
+			return nil, err
+		}
+		letter.Entity.Data = &entityData
+
+		letters = append(letters, letter)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	con.deadLetters.Lock()
+	if con.deadLetters.ids != nil {
+		for _, letter := range letters {
+			con.deadLetters.ids[con.deadLetterID(letter.Entity)] = true
+		}
+	}
+	con.deadLetters.Unlock()
+
+	var order = map[string]int{}
+	for i, entityType := range entityTypes {
+		order[entityType] = i
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return order[letters[i].Entity.Type] < order[letters[j].Entity.Type]
+	})
+
+	return letters, nil
+}
+
+// RemoveDeadLetter deletes the dead letter of an entity that has been written,
+// either replayed or superseded by a later upsert.
+func (con *DBConnection) RemoveDeadLetter(entity Entity) error {
+
+	var id = con.deadLetterID(entity)
+
+	con.deadLetters.Lock()
+	var unknown = con.deadLetters.ids != nil && !con.deadLetters.ids[id]
+	con.deadLetters.Unlock()
+	if unknown {
+		return nil
+	}
+
+	var stmt = "DELETE FROM " + con.qualify(con.deadLettersTable()) + " WHERE " + con.Dialect.Quote("$id") + " = " + con.Dialect.Placeholder(1)
+	if _, err := con.DB.Exec(stmt, id); err != nil {
+		return err
+	}
+
+	con.deadLetters.Lock()
+	if con.deadLetters.ids != nil {
+		delete(con.deadLetters.ids, id)
+	}
+	con.deadLetters.Unlock()
+	return nil
+}
+
+// Superseded reports whether the stored contact is newer than the contact of a
+// dead letter, replaying it would overwrite the newer version.
+func (con *DBConnection) Superseded(entity Entity) (bool, error) {
+
+	var column = con.columnName("contact", "$version")
+	var version, ok = (*entity.Data)["$version"].(string)
+	if entity.Type != "contact" || column == "" || !ok {
+		return false, nil
+	}
+
+	var q = con.Dialect.Quote
+	var stmt = "SELECT " + q(column) + " FROM " + con.qualify(con.tableName("contact")) + " WHERE " + q("$id") + " = " + con.Dialect.Placeholder(1)
+
+	rows, err := con.DB.Query(stmt, (*entity.Data)["$id"])
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	var stored sql.NullString
+	for rows.Next() {
+		if err = rows.Scan(&stored); err != nil {
+			return false, err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	return stored.Valid && newerVersion(stored.String, version), nil
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaySuperseded(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		stored     string // $version in the contacts table, "" = not stored
+		letter     string // $version of the dead letter
+		superseded bool
+		version    string // $version in the contacts table after the replay
+	}{
+		{"newer contact stored", "5", "4", true, "5"},
+		{"numeric order", "10", "9", true, "10"},
+		{"older contact stored", "4", "5", false, "5"},
+		{"same version", "5", "5", false, "5"},
+		{"contact not stored", "", "1", false, "1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var con = openTestDB(t, map[string]string{"Name": "text"}, nil)
+
+			if test.stored != "" {
+				if err := con.Upsert(testContact("a", test.stored, map[string]interface{}{"Name": "stored"})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := con.StoreDeadLetter(testContact("a", test.letter, map[string]interface{}{"Name": "letter"}), errors.New("timeout")); err != nil {
+				t.Fatal(err)
+			}
+
+			letters, err := con.DeadLetters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(letters) != 1 {
+				t.Fatalf("got %v dead letters, want 1", len(letters))
+			}
+
+			// As the replay mode
+			var letter = letters[0]
+			superseded, err := con.Superseded(letter.Entity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if superseded != test.superseded {
+				t.Errorf("got superseded %v, want %v", superseded, test.superseded)
+			}
+			if !superseded {
+				if err = con.Upsert(letter.Entity); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = con.RemoveDeadLetter(letter.Entity); err != nil {
+				t.Fatal(err)
+			}
+
+			if version := queryString(t, con, `SELECT "$version" FROM df_contacts WHERE "$id" = 'a'`); version != test.version {
+				t.Errorf("got contact version %v, want %v", version, test.version)
+			}
+			if count := queryString(t, con, "SELECT COUNT(*) FROM df_dead_letters"); count != "0" {
+				t.Errorf("got %v dead letters after the replay, want 0", count)
+			}
+		})
+	}
+}
+
+func TestDeadLetterFile(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		restored bool // Dead letter table available again before the import
+		letters  int  // Dead letters returned after the import
+		kept     bool // File still exists
+	}{
+		{"table restored", true, 2, false},
+		{"outage continues", false, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var fields = map[string]string{"Name": "text"}
+			var con = openTestDB(t, fields, nil)
+			con.DeadLetterFile = filepath.Join(t.TempDir(), "CAMPAIGN_dead_letters.jsonl")
+
+			// Outage of the dead letter table
+			if _, err := con.DB.Exec("DROP TABLE df_dead_letters"); err != nil {
+				t.Fatal(err)
+			}
+
+			var transaction = map[string]interface{}{"$id": "t1", "$contact_id": "a", "type": "call"}
+			for _, entity := range []Entity{{Type: "transaction", Data: &transaction}, testContact("a", "2", map[string]interface{}{"Name": "x"})} {
+				if err := con.StoreDeadLetter(entity, errors.New("connection refused")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := os.Stat(con.DeadLetterFile); err != nil {
+				t.Fatalf("dead letters not written to the file: %v", err)
+			}
+
+			if test.restored {
+				if err := con.UpdateTables(testCampaign(t, fields)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			letters, err := con.DeadLetters()
+			if test.restored && err != nil {
+				t.Fatal(err)
+			}
+			if !test.restored && err == nil {
+				t.Errorf("import without dead letter table succeeded")
+			}
+
+			if len(letters) != test.letters {
+				t.Fatalf("got %v dead letters, want %v", len(letters), test.letters)
+			}
+			if test.letters > 0 {
+				// Parents before their children, data restored from the file
+				if letters[0].Entity.Type != "contact" || (*letters[0].Entity.Data)["$version"] != "2" || letters[0].Error != "connection refused" {
+					t.Errorf("got dead letter %v %v %q", letters[0].Entity.Type, *letters[0].Entity.Data, letters[0].Error)
+				}
+			}
+
+			if _, err = os.Stat(con.DeadLetterFile); os.IsNotExist(err) == test.kept {
+				t.Errorf("got file kept %v, want %v", !os.IsNotExist(err), test.kept)
+			}
+		})
+	}
+}
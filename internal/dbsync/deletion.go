@@ -0,0 +1,199 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Handling of contacts that were deleted in Dialfire (DBConnection.DeletedContacts)
+const (
+	DeletedMark   = "mark"   // Set $deleted_at
+	DeletedDelete = "delete" // Delete the contact with its task log, transactions, connections and recordings
+)
+
+// ContactLister loads one page of the contact ids of the campaign, starting at the
+// cursor ("" = first page). The returned cursor is "" after the last page.
+type ContactLister func(cursor string) ([]string, string, error)
+
+// ReconcileContacts compares the contact ids listed by Dialfire with the contacts in the
+// database, contacts that no longer exist in Dialfire are marked as deleted or deleted.
+// Nothing is changed unless every page was listed. Returns the number of deleted contacts.
+func (con *DBConnection) ReconcileContacts(list ContactLister) (int, error) {
+
+	// Database first: contacts created in the meantime are listed by Dialfire
+	stored, err := con.ContactIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	var existing = map[string]bool{}
+	var cursor string
+	for {
+		ids, next, err := list(cursor)
+		if err != nil {
+			return 0, fmt.Errorf("contact ids incomplete, reconciliation skipped: %v", err)
+		}
+
+		for _, id := range ids {
+			existing[id] = true
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// Protect against an empty listing
+	if len(existing) == 0 && len(stored) > 0 {
+		return 0, errors.New("no contacts listed by Dialfire, reconciliation skipped")
+	}
+
+	var deleted []string
+	for id := range stored {
+		if !existing[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted)
+
+	if len(deleted) > 0 {
+		if err = con.DeleteContacts(deleted); err != nil {
+			return 0, err
+		}
+	}
+
+	debugLog.Printf("Reconcile deleted contacts | Campaign: %v | %v stored | %v listed | %v deleted (%v)", con.CampaignID, len(stored), len(existing), len(deleted), con.DeletedContacts)
+	return len(deleted), nil
+}
+
+// ContactIDs returns the $ids of all (not yet deleted) contacts of the campaign.
+func (con *DBConnection) ContactIDs() (map[string]bool, error) {
+
+	// Every contact carries its $campaign_id, the table may hold other campaigns
+	var quote = con.Dialect.Quote
+	var stmt = "SELECT " + quote("$id") + " FROM " + con.qualify(con.tableName("contact")) +
+		" WHERE " + quote("$campaign_id") + " = " + con.Dialect.Placeholder(1)
+
+	if con.DeletedContacts == DeletedMark {
+		stmt += " AND " + quote("$deleted_at") + " IS NULL"
+	}
+
+	rows, err := con.DB.Query(stmt, con.CampaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var ids = map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+
+	return ids, rows.Err()
+}
+
+// DeleteContacts marks the contacts as deleted or deletes them together with
+// their task logs, transactions, connections and recordings (see DeletedContacts).
+func (con *DBConnection) DeleteContacts(ids []string) error {
+
+	var chunkSize = con.Dialect.MaxParams() - 1
+	for start := 0; start < len(ids); start += chunkSize {
+
+		var end = start + chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var err error
+		if con.DeletedContacts == DeletedDelete {
+			err = con.deleteContacts(ids[start:end])
+		} else {
+			err = con.markContacts(ids[start:end])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (con *DBConnection) markContacts(ids []string) error {
+
+	var args = []interface{}{time.Now().UTC()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	var stmt = "UPDATE " + con.qualify(con.tableName("contact")) +
+		" SET " + con.Dialect.Quote("$deleted_at") + " = " + con.Dialect.Placeholder(1) +
+		" WHERE " + con.Dialect.Quote("$id") + " IN (" + con.placeholders(2, len(ids)) + ")"
+
+	_, err := con.DB.Exec(stmt, args...)
+	return err
+}
+
+// Children first, the contact history is kept
+func (con *DBConnection) deleteContacts(ids []string) error {
+
+	var args []interface{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	var conditions = con.contactConditions(con.placeholders(1, len(ids)))
+
+	tx, err := con.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	var types = con.syncedTypes()
+	for i := len(types) - 1; i >= 0; i-- {
+
+		var entityType = types[i]
+		var stmt = "DELETE FROM " + con.qualify(con.tableName(entityType)) + " WHERE " + conditions[entityType]
+
+		if _, err = tx.Exec(stmt, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Conditions selecting the rows of each entity type that belong to the contacts
+// with the ids in idList, e.g. the transactions of the contacts
+func (con *DBConnection) contactConditions(idList string) map[string]string {
+
+	var quote = con.Dialect.Quote
+	var conditions = map[string]string{"contact": quote("$id") + " IN (" + idList + ")"}
+	var parentIDs = map[string]string{"contact": idList}
+
+	for _, entityType := range con.syncedTypes()[1:] {
+		var relation = tableRelations[entityType]
+		conditions[entityType] = quote(relation.Column) + " IN (" + parentIDs[relation.Parent] + ")"
+		parentIDs[entityType] = "SELECT " + quote("$id") + " FROM " + con.qualify(con.tableName(entityType)) + " WHERE " + conditions[entityType]
+	}
+
+	return conditions
+}
+
+// Comma separated placeholders first, ..., first+count-1
+func (con *DBConnection) placeholders(first int, count int) string {
+
+	var params = make([]string, count)
+	for i := range params {
+		params[i] = con.Dialect.Placeholder(first + i)
+	}
+	return strings.Join(params, ",")
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestReconcileContacts(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		mode    string
+		pages   [][]string
+		failAt  int // Page that cannot be loaded, -1 = none
+		deleted []string
+		err     bool
+	}{
+		{"complete listing, mark", DeletedMark, [][]string{{"a"}, {"b"}}, -1, []string{"c"}, false},
+		{"complete listing, delete", DeletedDelete, [][]string{{"a", "b"}}, -1, []string{"c"}, false},
+		{"nothing deleted", DeletedMark, [][]string{{"a", "b", "c", "new"}}, -1, nil, false},
+		{"partial listing, mark", DeletedMark, [][]string{{"a"}, {"b"}, {"c"}}, 1, nil, true},
+		{"partial listing, delete", DeletedDelete, [][]string{{"a"}, {"b"}, {"c"}}, 2, nil, true},
+		{"first page fails", DeletedDelete, [][]string{{"a"}}, 0, nil, true},
+		{"empty listing", DeletedDelete, [][]string{{}}, -1, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var con = openTestDB(t, nil, func(con *DBConnection) { con.DeletedContacts = test.mode })
+
+			for _, id := range []string{"a", "b", "c"} {
+				if err := con.Upsert(testContact(id, "1", nil)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Contact of another campaign in the same table
+			var other = testContact("other", "1", map[string]interface{}{"$campaign_id": "OTHER"})
+			if err := con.Upsert(other); err != nil {
+				t.Fatal(err)
+			}
+
+			var list = func(cursor string) ([]string, string, error) {
+				var page, _ = strconv.Atoi(cursor)
+				if page == test.failAt {
+					return nil, "", errors.New("status 503")
+				}
+				var next string
+				if page+1 < len(test.pages) {
+					next = strconv.Itoa(page + 1)
+				}
+				return test.pages[page], next, nil
+			}
+
+			count, err := con.ReconcileContacts(list)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if count != len(test.deleted) {
+				t.Errorf("got %v deleted, want %v", count, len(test.deleted))
+			}
+
+			stored, err := con.ContactIDs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var missing []string
+			for _, id := range []string{"a", "b", "c"} {
+				if !stored[id] {
+					missing = append(missing, id)
+				}
+			}
+			sort.Strings(missing)
+			if !reflect.DeepEqual(missing, test.deleted) {
+				t.Errorf("got deleted %v, want %v", missing, test.deleted)
+			}
+
+			// Never touched by the reconciliation of this campaign
+			if stored["other"] {
+				t.Errorf("contact of another campaign listed")
+			}
+			var query = "SELECT COUNT(*) FROM df_contacts WHERE \"$id\" = 'other'"
+			if test.mode == DeletedMark {
+				query += " AND \"$deleted_at\" IS NULL"
+			}
+			if n := queryString(t, con, query); n != "1" {
+				t.Errorf("contact of another campaign deleted")
+			}
+		})
+	}
+}
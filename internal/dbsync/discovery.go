@@ -0,0 +1,171 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Entity types whose unknown attributes become columns (see DiscoverColumns),
+// contact columns are derived from the campaign form
+var discoverableTypes = map[string]bool{
+	"task_log":    true,
+	"transaction": true,
+	"connection":  true,
+	"recording":   true,
+}
+
+// Child entities still contained in the data of their parent
+var childKeys = map[string]bool{
+	"transactions": true,
+	"connections":  true,
+	"recordings":   true,
+}
+
+// Adds a column for every attribute of the entities that is not part of the
+// schema yet, typed by the Go type of its value. Every attribute is only
+// looked at once, the DDL is not repeated for failed or unsupported attributes.
+func (con *DBConnection) discoverColumns(entities []Entity) error {
+
+	if !con.DiscoverColumns {
+		return nil
+	}
+
+	// Entity type --> field --> Go type
+	var unseen = map[string]map[string]string{}
+
+	con.schemaMu.RLock()
+	for _, entity := range entities {
+
+		if !discoverableTypes[entity.Type] || con.Mapping[entity.Type].Exclude {
+			continue
+		}
+
+		for field, value := range *entity.Data {
+
+			if value == nil || childKeys[field] || con.seenFields[entity.Type][field] {
+				continue
+			}
+
+			if unseen[entity.Type] == nil {
+				unseen[entity.Type] = map[string]string{}
+			}
+			unseen[entity.Type][field] = reflect.TypeOf(value).String()
+		}
+	}
+	con.schemaMu.RUnlock()
+
+	if len(unseen) == 0 {
+		return nil
+	}
+
+	con.schemaMu.Lock()
+	defer con.schemaMu.Unlock()
+
+	for _, entityType := range entityTypes {
+		if fields := unseen[entityType]; fields != nil {
+			if err := con.addDiscoveredColumns(entityType, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Called with the schema locked for writing
+func (con *DBConnection) addDiscoveredColumns(entityType string, fields map[string]string) error {
+
+	var em = con.Mapping[entityType]
+	var columns = append([]map[string]string{}, con.tableSchemas[entityType]...)
+	var columnFields = map[string]string{}
+	for column, field := range con.columnFields[entityType] {
+		columnFields[column] = field
+	}
+
+	var newColumns = map[string]string{}
+	for field, goType := range fields {
+
+		// Discovered by another updater in the meantime
+		if con.seenFields[entityType][field] {
+			continue
+		}
+		con.seenFields[entityType][field] = true
+
+		var cm = em.Columns[field]
+		if cm.Exclude {
+			continue
+		}
+
+		var name, cType = field, goType
+		if cm.Name != "" {
+			name = cm.Name
+		}
+		if cm.Type != "" {
+			cType = cm.Type
+		}
+
+		if _, supported := con.Dialect.Types()[cType]; !supported {
+			debugLog.Printf("%v.%v: type %v not supported, attribute skipped", entityType, field, cType)
+			continue
+		}
+		if _, taken := columnFields[name]; taken {
+			debugLog.Printf("%v.%v: column %v already mapped, attribute skipped", entityType, field, name)
+			continue
+		}
+
+		newColumns[name] = cType
+		columnFields[name] = field
+		columns = append(columns, map[string]string{name: cType})
+	}
+
+	if len(newColumns) == 0 {
+		return nil
+	}
+
+	// Columns discovered by an earlier run (or another campaign) already exist
+	var tableName = con.tableName(entityType)
+	var existing = con.getTableColumns(tableName)
+	var missing = map[string]string{}
+	var names []string
+	for name, cType := range newColumns {
+		if existing[name] == "" {
+			missing[name] = cType
+			names = append(names, name)
+		}
+	}
+
+	if len(missing) > 0 {
+
+		sort.Strings(names)
+		debugLog.Printf("Discovered new columns in %v: %v", tableName, strings.Join(names, ", "))
+
+		if err := con.addTableColumns(tableName, missing); err != nil {
+
+			// Added concurrently by another process?
+			existing = con.getTableColumns(tableName)
+			for name := range missing {
+				if existing[name] == "" {
+					return err
+				}
+			}
+		}
+	}
+
+	// Copy on write, readers hold the previous schema
+	con.tableSchemas[entityType] = columns
+	con.columnFields[entityType] = columnFields
+	return nil
+}
+
+// Fields of the schema (and fields excluded by the mapping) are not discovered
+func (con *DBConnection) initSeenFields() {
+
+	con.seenFields = map[string]map[string]bool{}
+	for entityType := range discoverableTypes {
+
+		con.seenFields[entityType] = map[string]bool{}
+		for _, field := range con.columnFields[entityType] {
+			con.seenFields[entityType][field] = true
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// History of the contacts (slowly changing dimension type 2): one row per
+// $version, valid from the time it was synchronized until it was replaced.
+func (con *DBConnection) historyTable() string {
+	return con.tableName("contact") + "_history"
+}
+
+// Contact columns plus validity, $id identifies the version
+func historySchema(contactColumns []map[string]string) []map[string]string {
+
+	var columns = []map[string]string{
+		{"$id": "string"},
+		{"$contact_id": "id"},
+		{"$valid_from": "timestamp"},
+		{"$valid_to": "timestamp"},
+	}
+
+	for _, col := range contactColumns {
+		if _, isID := col["$id"]; !isID {
+			columns = append(columns, col)
+		}
+	}
+
+	return columns
+}
+
+// Appends the version of the contact to the history table (iff not yet recorded)
+// and closes the previous version. Runs in a transaction of its own unless q is one.
+func (con *DBConnection) appendHistory(q execer, contact Entity) error {
+
+	if db, ok := q.(*sql.DB); ok {
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err = con.appendHistory(tx, contact); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var contactID = (*contact.Data)["$id"]
+	var version, _ = (*contact.Data)["$version"].(string)
+
+	var sum = md5.Sum([]byte(contactID.(string) + "|" + version))
+	var versionID = hex.EncodeToString(sum[:])
+
+	var tableName = con.qualify(con.historyTable())
+	var quote = con.Dialect.Quote
+
+	// Concurrent updaters of the contact wait for each other (no-op update locks the contact row)
+	var stmt = "UPDATE " + con.qualify(con.tableName("contact")) + " SET " + quote("$campaign_id") + " = " + quote("$campaign_id") +
+		" WHERE " + quote("$id") + " = " + con.Dialect.Placeholder(1)
+	if _, err := q.Exec(stmt, contactID); err != nil {
+		return err
+	}
+
+	// Version already recorded --> keep its validity
+	var count int
+	stmt = "SELECT COUNT(*) FROM " + tableName + " WHERE " + quote("$id") + " = " + con.Dialect.Placeholder(1)
+	if err := q.QueryRow(stmt, versionID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	current, err := con.currentVersions(q, tableName, contactID)
+	if err != nil {
+		return err
+	}
+
+	var now = time.Now().UTC()
+
+	var data = make(map[string]interface{}, len(*contact.Data)+4)
+	for key, value := range *contact.Data {
+		data[key] = value
+	}
+	data["$id"] = versionID
+	data["$contact_id"] = contactID
+	data["$valid_from"] = now
+
+	// A version older than the current one (received out of order) is recorded as closed
+	var outdated = false
+	for _, currentVersion := range current {
+		if !newerVersion(version, currentVersion) {
+			outdated = true
+		}
+	}
+
+	if outdated {
+		data["$valid_to"] = now
+	} else {
+
+		// Close the current version
+		stmt = "UPDATE " + tableName + " SET " + quote("$valid_to") + " = " + con.Dialect.Placeholder(1) +
+			" WHERE " + quote("$contact_id") + " = " + con.Dialect.Placeholder(2) + " AND " + quote("$valid_to") + " IS NULL"
+		if _, err = q.Exec(stmt, now, contactID); err != nil {
+			return err
+		}
+	}
+
+	var fieldNames, values = con.row(Entity{Type: "contact_history", Data: &data})
+	return con.upsertRow(q, tableName, fieldNames, values, versionID)
+}
+
+// $version of the open rows of a contact (none if $version is excluded by the mapping)
+func (con *DBConnection) currentVersions(q execer, tableName string, contactID interface{}) ([]string, error) {
+
+	var column = con.columnName("contact", "$version")
+	if column == "" {
+		return nil, nil
+	}
+
+	var quote = con.Dialect.Quote
+	var stmt = "SELECT " + quote(column) + " FROM " + tableName +
+		" WHERE " + quote("$contact_id") + " = " + con.Dialect.Placeholder(1) + " AND " + quote("$valid_to") + " IS NULL"
+
+	rows, err := q.Query(stmt, contactID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var versions []string
+	for rows.Next() {
+		var version sql.NullString
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		if version.Valid {
+			versions = append(versions, version.String)
+		}
+	}
+
+	return versions, rows.Err()
+}
+
+// Dialfire versions are increasing numbers
+func newerVersion(version string, than string) bool {
+
+	v1, err1 := strconv.ParseInt(version, 10, 64)
+	v2, err2 := strconv.ParseInt(than, 10, 64)
+	if err1 == nil && err2 == nil {
+		return v1 > v2
+	}
+	return version > than
+}
+
+// Appends the contacts among the entities to the history (iff enabled)
+func (con *DBConnection) appendHistories(q execer, entities []Entity) error {
+
+	if !con.History {
+		return nil
+	}
+
+	for _, entity := range entities {
+		if entity.Type != "contact" {
+			continue
+		}
+		if err := con.appendHistory(q, entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestHistoryVersions(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		versions []string // $versions of contact "a" in the order they are written
+		open     string   // $version of the open history row
+		rows     string   // Number of history rows
+	}{
+		{"ascending", []string{"1", "2", "3"}, "3", "3"},
+		{"out of order", []string{"1", "3", "2"}, "3", "3"},
+		{"numeric order", []string{"9", "10"}, "10", "2"},
+		{"repeated", []string{"1", "2", "2", "1"}, "2", "2"},
+		{"outdated first", []string{"5", "4"}, "5", "2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var fields = map[string]string{"Newsletter": "checkbox", "Age": "number"}
+			var con = openTestDB(t, fields, func(con *DBConnection) { con.History = true })
+
+			for _, version := range test.versions {
+				// Empty checkbox and number fields
+				var contact = testContact("a", version, map[string]interface{}{"Newsletter": "", "Age": ""})
+				if err := con.Upsert(contact); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var query = `SELECT "$version" FROM df_contacts_history WHERE "$contact_id" = 'a' AND "$valid_to" IS NULL`
+			if version := queryString(t, con, query); version != test.open {
+				t.Errorf("got open version %v, want %v", version, test.open)
+			}
+
+			query = `SELECT COUNT(*) FROM df_contacts_history WHERE "$contact_id" = 'a'`
+			if rows := queryString(t, con, query); rows != test.rows {
+				t.Errorf("got %v history rows, want %v", rows, test.rows)
+			}
+
+			query = `SELECT COUNT(*) FROM df_contacts_history WHERE "$valid_to" IS NULL`
+			if rows := queryString(t, con, query); rows != "1" {
+				t.Errorf("got %v open history rows, want 1", rows)
+			}
+
+			query = `SELECT COUNT(*) FROM df_contacts_history WHERE "Newsletter" IS NOT NULL OR "Age" IS NOT NULL`
+			if rows := queryString(t, con, query); rows != "0" {
+				t.Errorf("empty fields stored in %v history rows", rows)
+			}
+		})
+	}
+}
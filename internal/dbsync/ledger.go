@@ -0,0 +1,196 @@
+package database
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ledger of all schema changes applied by dbsync, e.g. "df_schema_migrations"
+func (con *DBConnection) migrationsTable() string {
+	return strings.ToLower(con.TablePrefix) + "schema_migrations"
+}
+
+var migrationsSchema = []map[string]string{
+	{"$id": "string"},
+	{"campaign_id": "string"},
+	{"form_hash": "string"},
+	{"statement": "text"},
+	{"applied_at": "timestamp"},
+}
+
+// Recorded if the form of the campaign changed without requiring a schema change
+const noSchemaChange = "-- schema up to date"
+
+// Snapshot hash of the campaign form (the fields the schema is derived from)
+func formHash(campaign Campaign) string {
+
+	data, err := json.Marshal(campaign.Form)
+	if err != nil {
+		panic(err)
+	}
+
+	var sum = md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates the ledger table and returns the form hash of the last migration of the campaign
+func (con *DBConnection) openLedger() (string, error) {
+
+	if err := con.createTable(con.migrationsTable(), migrationsSchema); err != nil {
+		return "", err
+	}
+
+	var table = con.qualify(con.migrationsTable())
+	var q = con.Dialect.Quote
+	var stmt = "SELECT " + q("form_hash") + " FROM " + table +
+		" WHERE " + q("campaign_id") + " = " + con.Dialect.Placeholder(1) +
+		" AND " + q("applied_at") + " = (SELECT MAX(" + q("applied_at") + ") FROM " + table +
+		" WHERE " + q("campaign_id") + " = " + con.Dialect.Placeholder(2) + ")"
+
+	rows, err := con.DB.Query(stmt, con.CampaignID, con.CampaignID)
+	if err != nil {
+		return "", err
+	}
+
+	defer rows.Close()
+
+	var lastHash string
+	for rows.Next() {
+		if err = rows.Scan(&lastHash); err != nil {
+			return "", err
+		}
+	}
+
+	return lastHash, rows.Err()
+}
+
+// Reconciles the ledger with the desired schema of the current campaign form:
+// every statement applied by applySchema is recorded, a changed form that
+// required no DDL is recorded as well. Drift of the live tables from the schema
+// recorded for an unchanged form (e.g. columns dropped or altered manually) is
+// recorded and repaired by applySchema, drift that remains is reported.
+func (con *DBConnection) reconcileSchema(campaign Campaign, applySchema func() error) error {
+
+	// The ledger itself is not recorded (formHash not yet set)
+	lastHash, err := con.openLedger()
+	if err != nil {
+		return err
+	}
+
+	con.formHash = formHash(campaign)
+
+	switch lastHash {
+	case "":
+		debugLog.Printf("No schema migrations recorded for campaign %v", con.CampaignID)
+	case con.formHash:
+		debugLog.Printf("Campaign form unchanged since last schema migration (%v)", con.formHash)
+	default:
+		debugLog.Printf("Campaign form changed since last schema migration (%v --> %v)", lastHash, con.formHash)
+	}
+
+	con.migrations = 0
+
+	if lastHash == con.formHash {
+		if missing, divergent := con.schemaDrift(); len(missing)+len(divergent) > 0 {
+			var drift = append(missing, divergent...)
+			errorLog.Printf("Schema drift since last migration of campaign %v:\n%v\n", con.CampaignID, strings.Join(drift, "\n"))
+			con.recordMigration("-- schema drift: " + strings.Join(drift, ", "))
+		}
+	}
+
+	if err = applySchema(); err != nil {
+		return err
+	}
+
+	if con.migrations == 0 && lastHash != con.formHash {
+		con.recordMigration(noSchemaChange)
+	}
+
+	debugLog.Printf("%v schema statements applied", con.migrations)
+
+	// Column types the dialect cannot change are kept (e.g. SQLite)
+	var missing, divergent = con.schemaDrift()
+	if len(divergent) > 0 {
+		errorLog.Printf("Column types differ from the schema:\n%v\n", strings.Join(divergent, "\n"))
+	}
+	if len(missing) > 0 {
+		return errors.New("schema could not be reconciled, missing:\n" + strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+// Tables and columns of the desired schema that are missing in the database,
+// and columns whose type family differs
+func (con *DBConnection) schemaDrift() (missing []string, divergent []string) {
+
+	var tables = map[string]string{} // Table --> entity type
+	for _, entityType := range con.syncedTypes() {
+		tables[con.tableName(entityType)] = entityType
+	}
+	if con.History {
+		tables[con.historyTable()] = "contact_history"
+	}
+
+	var names []string
+	for tableName := range tables {
+		names = append(names, tableName)
+	}
+	sort.Strings(names)
+
+	for _, tableName := range names {
+
+		var existing = con.getTableColumns(tableName)
+		if len(existing) == 0 {
+			missing = append(missing, tableName)
+			continue
+		}
+
+		for _, col := range con.tableSchemas[tables[tableName]] {
+			for cName, cType := range col {
+
+				var currentType = existing[cName]
+				var dbType = con.toDBType(cType)
+				switch {
+				case currentType == "":
+					missing = append(missing, tableName+"."+cName)
+				case con.Dialect.TypeFamily(currentType) != con.Dialect.TypeFamily(dbType):
+					divergent = append(divergent, fmt.Sprintf("%v.%v: %v, expected %v", tableName, cName, currentType, dbType))
+				}
+			}
+		}
+	}
+
+	return missing, divergent
+}
+
+// Writes an applied DDL statement or a note (e.g. schema drift) into the ledger.
+// Errors are logged only, the schema change itself has already been applied.
+func (con *DBConnection) recordMigration(stmt string) {
+
+	if con.formHash == "" {
+		return // ledger not opened
+	}
+
+	var appliedAt = time.Now().UTC()
+	var sum = md5.Sum([]byte(fmt.Sprintf("%v|%v|%v|%v", con.CampaignID, con.formHash, stmt, appliedAt.UnixNano())))
+
+	var cols = []string{"$id", "campaign_id", "form_hash", "statement", "applied_at"}
+	var params []string
+	for i, col := range cols {
+		cols[i] = con.Dialect.Quote(col)
+		params = append(params, con.Dialect.Placeholder(i+1))
+	}
+
+	var insert = "INSERT INTO " + con.qualify(con.migrationsTable()) + " (" + strings.Join(cols, ",") + ") VALUES (" + strings.Join(params, ",") + ")"
+	if _, err := con.DB.Exec(insert, hex.EncodeToString(sum[:]), con.CampaignID, con.formHash, stmt, appliedAt); err != nil {
+		errorLog.Printf("Schema migration not recorded: %v\n", stmt)
+		errorLog.Printf("%v \n", err.Error())
+		return
+	}
+}
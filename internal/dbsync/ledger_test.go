@@ -0,0 +1,45 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestReconcileSchemaDrift(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		drift      string // Statement changing the live tables
+		migrations int    // Schema statements applied by the second UpdateTables
+		notes      string // Drift notes in the ledger
+	}{
+		{"no drift", "", 0, "0"},
+		{"table dropped", "DROP TABLE df_recordings", 1, "1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var fields = map[string]string{"Name": "text"}
+			var con = openTestDB(t, fields, nil)
+
+			if test.drift != "" {
+				if _, err := con.DB.Exec(test.drift); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := con.UpdateTables(testCampaign(t, fields)); err != nil {
+				t.Fatal(err)
+			}
+
+			if con.migrations != test.migrations {
+				t.Errorf("got %v schema statements applied, want %v", con.migrations, test.migrations)
+			}
+
+			var query = `SELECT COUNT(*) FROM df_schema_migrations WHERE statement LIKE '-- schema drift:%'`
+			if notes := queryString(t, con, query); notes != test.notes {
+				t.Errorf("got %v drift notes, want %v", notes, test.notes)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Mapping of the Dialfire fields onto tables and columns, e.g.
+//
+//	{
+//	  "recording": {"exclude": true},
+//	  "contact": {"columns": {"$recording_url": {"exclude": true}, "Kundennummer": {"name": "customer_no", "type": "int"}}}
+//	}
+type Mapping map[string]EntityMapping
+
+type EntityMapping struct {
+	Exclude bool                     `json:"exclude"` // Skip the whole table (requires the child entities to be excluded as well)
+	Columns map[string]ColumnMapping `json:"columns"` // Field name --> column
+}
+
+type ColumnMapping struct {
+	Name    string `json:"name"`    // Column name, default: field name
+	Type    string `json:"type"`    // Logical type (string, text, int, bool, timestamp, ...), default: type of the field
+	Exclude bool   `json:"exclude"` // Skip the field
+}
+
+// LoadMapping reads and validates a mapping file (JSON, YAML is not supported).
+func LoadMapping(filePath string) (Mapping, error) {
+
+	// A YAML file would fail with a misleading JSON syntax error
+	if !strings.EqualFold(filepath.Ext(filePath), ".json") {
+		return nil, errors.New(filePath + ": mapping files must be JSON (.json), YAML is not supported")
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var mapping Mapping
+	if err = json.Unmarshal(data, &mapping); err != nil {
+		return nil, errors.New(filePath + ": " + err.Error())
+	}
+
+	if err = mapping.validate(); err != nil {
+		return nil, errors.New(filePath + ": " + err.Error())
+	}
+
+	return mapping, nil
+}
+
+func (m Mapping) validate() error {
+
+	for entityType, em := range m {
+
+		if _, known := tableSchemas[entityType]; !known {
+			return fmt.Errorf("unknown entity '%v'", entityType)
+		}
+
+		if em.Exclude {
+			if entityType == "contact" {
+				return errors.New("the contacts cannot be excluded")
+			}
+			for child, relation := range tableRelations {
+				if relation.Parent == entityType && !m[child].Exclude {
+					return fmt.Errorf("entity '%v' excluded, but not its child entity '%v'", entityType, child)
+				}
+			}
+		}
+
+		// Columns joining the tables or maintained by dbsync itself
+		for field := range em.Columns {
+			switch field {
+			case "$id", "$campaign_id", "$deleted_at", "$task_log_id", extraColumn, tableRelations[entityType].Column:
+				return fmt.Errorf("%v.%v cannot be mapped", entityType, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Entity types written to the database (parents before their children)
+func (con *DBConnection) syncedTypes() []string {
+
+	var types []string
+	for _, entityType := range entityTypes {
+		if !con.Mapping[entityType].Exclude {
+			types = append(types, entityType)
+		}
+	}
+	return types
+}
+
+// Applies the mapping to the columns of the campaign: excluded fields are removed,
+// the field of every column is recorded in columnFields.
+func (con *DBConnection) applyMapping() error {
+
+	con.columnFields = map[string]map[string]string{}
+
+	for _, entityType := range entityTypes {
+
+		var em = con.Mapping[entityType]
+		if em.Exclude {
+			delete(con.tableSchemas, entityType)
+			continue
+		}
+
+		var columns []map[string]string
+		var fields = map[string]string{}
+		for _, col := range con.tableSchemas[entityType] {
+			for field, fieldType := range col {
+
+				var cm = em.Columns[field]
+				if cm.Exclude {
+					continue
+				}
+
+				var name = field
+				if cm.Name != "" {
+					name = cm.Name
+				}
+				if cm.Type != "" {
+					if _, known := con.Dialect.Types()[cm.Type]; !known {
+						return fmt.Errorf("%v.%v: unknown type '%v'", entityType, field, cm.Type)
+					}
+					fieldType = cm.Type
+				}
+
+				if _, taken := fields[name]; taken {
+					return fmt.Errorf("%v: column '%v' mapped twice", entityType, name)
+				}
+				fields[name] = field
+				columns = append(columns, map[string]string{name: fieldType})
+			}
+		}
+
+		con.tableSchemas[entityType] = columns
+		con.columnFields[entityType] = fields
+	}
+
+	return nil
+}
+
+// Field of the entity data written into the column
+func (con *DBConnection) fieldName(entityType string, column string) string {
+
+	if field, mapped := con.columnFields[entityType][column]; mapped {
+		return field
+	}
+	return column
+}
+
+// Column the field is written into, "" if the field is excluded
+func (con *DBConnection) columnName(entityType string, field string) string {
+
+	for column, f := range con.columnFields[entityType] {
+		if f == field {
+			return column
+		}
+	}
+
+	if con.Mapping[entityType].Columns[field].Exclude {
+		return ""
+	}
+	return field
+}
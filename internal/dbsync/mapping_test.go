@@ -0,0 +1,42 @@
+package database
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMapping(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		fileName string
+		content  string
+		err      string // Expected part of the error, "" = valid
+	}{
+		{"json", "mapping.json", `{"contact": {"columns": {"Kundennummer": {"name": "customer_no", "type": "int"}}}}`, ""},
+		{"json upper case", "MAPPING.JSON", `{"recording": {"exclude": true}}`, ""},
+		{"yaml", "mapping.yaml", "contact:\n  columns:\n    Kundennummer:\n      name: customer_no\n", "YAML is not supported"},
+		{"yml", "mapping.yml", "recording:\n  exclude: true\n", "YAML is not supported"},
+		{"invalid json", "mapping.json", `{"contact": `, "mapping.json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var filePath = filepath.Join(t.TempDir(), test.fileName)
+			if err := ioutil.WriteFile(filePath, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadMapping(filePath)
+			if test.err == "" && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compares the column types of a table with the schema and converts the columns whose
+// type family changed (e.g. a campaign field changed from "text" to "number").
+// Conversions that would lose data are not executed but returned as error.
+func (con *DBConnection) updateColumnTypes(tableName string, columns []map[string]string) error {
+
+	var existingColumns = con.getTableColumns(tableName)
+
+	var refused []string
+	for _, col := range columns {
+		for cName, cType := range col {
+
+			var currentType = existingColumns[cName]
+			if currentType == "" {
+				continue // new column
+			}
+
+			var dbType = con.toDBType(cType)
+			var from = con.Dialect.TypeFamily(currentType)
+			var to = con.Dialect.TypeFamily(dbType)
+			if from == to {
+				continue
+			}
+
+			var change = fmt.Sprintf("%v.%v: %v --> %v", tableName, cName, currentType, dbType)
+
+			var stmts = con.Dialect.AlterColumnType(con.qualify(tableName), cName, currentType, dbType)
+			if len(stmts) == 0 {
+				debugLog.Printf("Column type change not supported by %v, keep %v", con.DBType, change)
+				continue
+			}
+
+			if reason := con.checkConversion(tableName, cName, from, to); reason != "" {
+				refused = append(refused, change+" ("+reason+")")
+				continue
+			}
+
+			debugLog.Printf("Change column type %v", change)
+			for _, stmt := range stmts {
+				if err := con.exec(stmt); err != nil {
+					refused = append(refused, change+" ("+err.Error()+")")
+					break
+				}
+			}
+		}
+	}
+
+	if len(refused) > 0 {
+		return errors.New("column types could not be changed without losing data, please migrate manually:\n" + strings.Join(refused, "\n"))
+	}
+	return nil
+}
+
+// Checks whether all values of the column can be converted from one type family into
+// another. Returns the reason if data would be lost.
+func (con *DBConnection) checkConversion(tableName string, column string, from string, to string) string {
+
+	var convertible func(value string) bool
+
+	switch to {
+
+	case "text":
+		return "" // widening
+
+	case "string":
+		if from != "text" {
+			return "" // numbers, booleans, dates and json fit into varchar(255)
+		}
+		convertible = func(value string) bool {
+			return len([]rune(value)) <= 255
+		}
+
+	case "numeric":
+		if from == "bool" {
+			// Booleans are read as true/false (Postgres, SQL Server) or 0/1 (MySQL)
+			convertible = func(value string) bool {
+				_, err := strconv.ParseBool(value)
+				return err == nil
+			}
+			break
+		}
+		convertible = func(value string) bool {
+			// NaN and Inf are accepted by ParseFloat, but not by numeric columns
+			f, err := strconv.ParseFloat(value, 64)
+			return err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+		}
+
+	case "bool":
+		convertible = func(value string) bool {
+			switch strings.ToLower(value) {
+			case "0", "1", "true", "false":
+				return true
+			}
+			return false
+		}
+
+	case "timestamp":
+		convertible = func(value string) bool {
+			_, ok := toTimestamp(value).(time.Time)
+			return ok
+		}
+
+	case "json":
+		convertible = func(value string) bool {
+			return json.Valid([]byte(value))
+		}
+
+	default:
+		return "unknown type " + to
+	}
+
+	var q = con.Dialect.Quote(column)
+	var stmt = "SELECT DISTINCT " + q + " FROM " + con.qualify(tableName) + " WHERE " + q + " IS NOT NULL"
+
+	rows, err := con.DB.Query(stmt)
+	if err != nil {
+		return err.Error()
+	}
+
+	defer rows.Close()
+
+	var failed = 0
+	var example string
+	var value string
+	for rows.Next() {
+		if err = rows.Scan(&value); err != nil {
+			return err.Error()
+		}
+		if !convertible(value) {
+			if failed == 0 {
+				example = value
+			}
+			failed++
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err.Error()
+	}
+
+	if failed > 0 {
+		return fmt.Sprintf("%v distinct values cannot be converted, e.g. '%v'", failed, example)
+	}
+	return ""
+}
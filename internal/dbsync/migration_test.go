@@ -0,0 +1,94 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// SQLite keeps the declared column types, the conversion is simulated by
+// rewriting the values (like the USING clause on Postgres)
+type convertingDialect struct {
+	sqliteDialect
+}
+
+func (d convertingDialect) AlterColumnType(tableName string, column string, currentType string, dbType string) []string {
+
+	var q = d.Quote(column)
+	switch d.TypeFamily(dbType) {
+
+	case "numeric":
+		return []string{"UPDATE " + tableName + " SET " + q + " = CASE lower(" + q + ") WHEN 'true' THEN 1 WHEN 'false' THEN 0 ELSE CAST(" + q + " AS NUMERIC) END;"}
+
+	case "bool":
+		return []string{"UPDATE " + tableName + " SET " + q + " = CASE WHEN " + q + " <> 0 THEN 'true' ELSE 'false' END;"}
+	}
+	return []string{"SELECT 1;"}
+}
+
+func TestUpdateColumnTypes(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		from      string   // Field type of the existing column
+		to        string   // Field type in the changed form
+		values    []string // Stored values (sorted)
+		converted []string // Values after the conversion (sorted), nil = refused
+	}{
+		{"bool to numeric", "checkbox", "number", []string{"false", "true"}, []string{"0", "1"}},
+		{"bool as 0/1 to numeric", "checkbox", "number", []string{"0", "1"}, []string{"0", "1"}},
+		{"numeric to bool", "number", "checkbox", []string{"0", "1"}, []string{"false", "true"}},
+		{"string to numeric", "text", "number", []string{"12", "7"}, []string{"12", "7"}},
+		{"string to numeric refused", "text", "number", []string{"12", "twelve"}, nil},
+		{"NaN refused", "text", "number", []string{"NaN"}, nil},
+		{"Inf refused", "text", "number", []string{"+Inf", "1"}, nil},
+		{"numeric to bool refused", "number", "checkbox", []string{"0.5", "1", "x"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var con = openTestDB(t, map[string]string{"Field": test.from}, func(con *DBConnection) { con.Dialect = convertingDialect{} })
+
+			for i, value := range test.values {
+				var stmt = `INSERT INTO df_contacts ("$id", "$campaign_id", "Field") VALUES (?, ?, ?)`
+				if _, err := con.DB.Exec(stmt, string(rune('a'+i)), testCampaignID, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var err = con.UpdateTables(testCampaign(t, map[string]string{"Field": test.to}))
+
+			var values []string
+			rows, qErr := con.DB.Query(`SELECT DISTINCT CAST("Field" AS TEXT) FROM df_contacts ORDER BY 1`)
+			if qErr != nil {
+				t.Fatal(qErr)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var value string
+				if qErr = rows.Scan(&value); qErr != nil {
+					t.Fatal(qErr)
+				}
+				values = append(values, value)
+			}
+
+			if test.converted == nil {
+				if err == nil || !strings.Contains(err.Error(), "df_contacts.Field") {
+					t.Errorf("got error %v, want refused conversion", err)
+				}
+				if !reflect.DeepEqual(values, test.values) {
+					t.Errorf("refused conversion changed values: %v", values)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.converted) {
+				t.Errorf("got %v, want %v", values, test.converted)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteDialect struct{}
+
+func init() {
+	Register(sqliteDialect{})
+}
+
+var sqliteTypes = map[string]string{
+	"id":                      "varchar(100)",
+	"string":                  "varchar(255)",
+	"text":                    "text",
+	"timestamp":               "datetime",
+	"int":                     "numeric",
+	"float64":                 "numeric",
+	"json.Number":             "numeric",
+	"bool":                    "boolean",
+	"json":                    "text",
+	"map[string]interface {}": "text",
+	"[]interface {}":          "text",
+}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Driver() string {
+	return "sqlite3"
+}
+
+// SQLite: 'sqlite://path/to/file.db' (relative) or 'sqlite:///var/lib/dbsync/file.db' (absolute)
+func (sqliteDialect) DSN(u *url.URL) (string, error) {
+
+	var path = u.Host + u.Path
+	if path == "" {
+		return "", errors.New("database file is required, e.g. 'sqlite:///var/lib/dbsync/file.db'")
+	}
+
+	// Concurrent database updaters wait for the write lock instead of failing with "database is locked"
+	var query = u.Query()
+	if query.Get("_busy_timeout") == "" {
+		query.Set("_busy_timeout", "10000")
+	}
+	if query.Get("_journal_mode") == "" {
+		query.Set("_journal_mode", "WAL")
+	}
+
+	return "file:" + path + "?" + query.Encode(), nil
+}
+
+// Local database file
+func (sqliteDialect) TLS(opts TLSOptions, query url.Values) error {
+	return errors.New("TLS is not supported by sqlite")
+}
+
+func (sqliteDialect) Types() map[string]string {
+	return sqliteTypes
+}
+
+func (sqliteDialect) Quote(identifier string) string {
+	return "\"" + identifier + "\""
+}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?" + strconv.Itoa(n)
+}
+
+func (d sqliteDialect) CreateTable(tableName string, columns []map[string]string, b *bytes.Buffer) {
+
+	var cols []string
+	for i := 0; i < len(columns); i++ {
+		for cName, cType := range columns[i] {
+			var def = ""
+			if cName == "$id" {
+				def = d.Quote("$id") + " varchar(100) NOT NULL PRIMARY KEY "
+			} else {
+				def = d.Quote(cName) + " " + toDBType(d, cType)
+			}
+			cols = append(cols, def)
+		}
+	}
+
+	b.WriteString("CREATE TABLE IF NOT EXISTS ")
+	b.WriteString(tableName)
+	b.WriteString("(" + strings.Join(cols, ",") + ")")
+	b.WriteString(";")
+}
+
+func (d sqliteDialect) AddColumns(tableName string, columns map[string]string, b *bytes.Buffer) {
+
+	// SQLite only supports one column per ALTER TABLE statement
+	for key, value := range columns {
+		b.WriteString("ALTER TABLE ")
+		b.WriteString(tableName)
+		b.WriteString(" ADD COLUMN ")
+		b.WriteString(d.Quote(key) + " ")
+		b.WriteString(toDBType(d, value))
+		b.WriteString(";")
+	}
+}
+
+func (d sqliteDialect) PrepareUpsert(tableName string, columns []string, b *bytes.Buffer) {
+
+	// Convert keys and values to string array
+	var cols []string
+	var insertData []string
+	var updateData []string
+	for idx, col := range columns {
+		cols = append(cols, d.Quote(col))
+		insertData = append(insertData, d.Placeholder(idx+1))
+		updateData = append(updateData, d.Quote(col)+"="+d.Placeholder(len(columns)+idx+1))
+	}
+
+	// Insert data
+	b.WriteString("INSERT INTO ")
+	b.WriteString(tableName)
+	b.WriteString(" (")
+	b.WriteString(strings.Join(cols, ","))
+	b.WriteString(") ")
+	b.WriteString("VALUES")
+	b.WriteString(" (")
+	b.WriteString(strings.Join(insertData, ","))
+	b.WriteString(")")
+	b.WriteString(" ON CONFLICT ")
+	b.WriteString("(" + d.Quote("$id") + ")")
+	b.WriteString(" DO UPDATE SET ")
+	b.WriteString(strings.Join(updateData, ","))
+	b.WriteString(";")
+}
+
+func (sqliteDialect) UpsertArgs(id interface{}, values []interface{}) []interface{} {
+
+	// Daten duplizieren (1. Insert / 2. Update)
+	return append(values, values...)
+}
+
+func (d sqliteDialect) PrepareBatchUpsert(tableName string, columns []string, rows int, b *bytes.Buffer) {
+
+	var cols []string
+	var updateData []string
+	for _, col := range columns {
+		cols = append(cols, d.Quote(col))
+		updateData = append(updateData, d.Quote(col)+"=excluded."+d.Quote(col))
+	}
+
+	b.WriteString("INSERT INTO ")
+	b.WriteString(tableName)
+	b.WriteString(" (")
+	b.WriteString(strings.Join(cols, ","))
+	b.WriteString(") ")
+	b.WriteString("VALUES ")
+	writeValueRows(d, len(columns), rows, b)
+	b.WriteString(" ON CONFLICT ")
+	b.WriteString("(" + d.Quote("$id") + ")")
+	b.WriteString(" DO UPDATE SET ")
+	b.WriteString(strings.Join(updateData, ","))
+	b.WriteString(";")
+}
+
+func (sqliteDialect) MaxParams() int {
+	return 999 // SQLITE_MAX_VARIABLE_NUMBER of older SQLite versions
+}
+
+func (sqliteDialect) MaxFields() int {
+	return 900 // A batch row (fields plus fixed contact and history columns) must fit into MaxParams
+}
+
+// Stored as text, not as blob
+func (sqliteDialect) JSONArg(document []byte) interface{} {
+	return string(document)
+}
+
+func (sqliteDialect) TableColumnsQuery(schema string, tableName string) string {
+	return "SELECT name, type FROM pragma_table_info('" + tableName + "', '" + sqliteSchema(schema) + "');"
+}
+
+// The schema of a table is the name of an attached database
+func sqliteSchema(schema string) string {
+	if schema == "" {
+		return "main"
+	}
+	return schema
+}
+
+var sqliteFamilies = map[string]string{
+	"varchar":  "string",
+	"text":     "text",
+	"numeric":  "numeric",
+	"boolean":  "bool",
+	"datetime": "timestamp",
+}
+
+func (sqliteDialect) TypeFamily(dbType string) string {
+	return typeFamily(dbType, sqliteFamilies)
+}
+
+// Column types are not enforced by SQLite (type affinity), existing columns are kept
+func (sqliteDialect) AlterColumnType(tableName string, column string, currentType string, dbType string) []string {
+	return nil
+}
+
+func (d sqliteDialect) CreateIndex(tableName string, indexName string, column string, b *bytes.Buffer) {
+
+	// Qualified tables: the schema belongs to the index name (CREATE INDEX s.idx ON tbl)
+	if idx := strings.Index(tableName, "."); idx >= 0 {
+		indexName = tableName[:idx+1] + indexName
+		tableName = tableName[idx+1:]
+	}
+	b.WriteString("CREATE INDEX IF NOT EXISTS " + indexName + " ON " + tableName + " (" + d.Quote(column) + ");")
+}
+
+// SQLite only supports foreign keys in CREATE TABLE, foreign keys are not supported (CLI arg 'fk')
+func (sqliteDialect) AddForeignKey(tableName string, constraintName string, column string, parentTable string, b *bytes.Buffer) {
+}
+
+func (sqliteDialect) TableConstraintsQuery(schema string, tableName string) string {
+	return "SELECT name FROM " + sqliteSchema(schema) + ".sqlite_master WHERE type = 'index' AND tbl_name = '" + tableName + "';"
+}
+
+// SQLite has no users and privileges
+func (sqliteDialect) Grant(tableName string, role string, b *bytes.Buffer) {
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const testCampaignID = "CAMPAIGN"
+
+// SQLite database in a temporary directory with the tables of a campaign with the
+// given form fields (name --> fieldType), setup configures the connection first
+func openTestDB(t *testing.T, fields map[string]string, setup func(con *DBConnection)) *DBConnection {
+
+	t.Helper()
+
+	var logger = log.New(ioutil.Discard, "", 0)
+	pool, err := Open("sqlite", "sqlite://"+filepath.Join(t.TempDir(), "dbsync.db"), logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.DB.Close() })
+
+	var con = pool.WithCampaign(testCampaignID)
+	if setup != nil {
+		setup(con)
+	}
+
+	if err = con.UpdateTables(testCampaign(t, fields)); err != nil {
+		t.Fatal(err)
+	}
+	return con
+}
+
+// Campaign with the form fields name --> fieldType
+func testCampaign(t *testing.T, fields map[string]string) Campaign {
+
+	t.Helper()
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var elements []map[string]interface{}
+	for _, name := range names {
+		elements = append(elements, map[string]interface{}{"type": "field", "name": name, "fieldType": fields[name]})
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"form": map[string]interface{}{"elements": elements}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var campaign Campaign
+	if err = json.Unmarshal(data, &campaign); err != nil {
+		t.Fatal(err)
+	}
+	return campaign
+}
+
+// Contact of the test campaign
+func testContact(id string, version string, fields map[string]interface{}) Entity {
+
+	var data = map[string]interface{}{"$id": id, "$version": version, "$campaign_id": testCampaignID}
+	for name, value := range fields {
+		data[name] = value
+	}
+	return Entity{Type: "contact", Data: &data}
+}
+
+// Single value of a query, "" for NULL
+func queryString(t *testing.T, con *DBConnection, stmt string, args ...interface{}) string {
+
+	t.Helper()
+
+	var value *string
+	if err := con.DB.QueryRow(stmt, args...).Scan(&value); err != nil {
+		t.Fatalf("%v: %v", stmt, err)
+	}
+	if value == nil {
+		return ""
+	}
+	return *value
+}
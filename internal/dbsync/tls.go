@@ -0,0 +1,108 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Verification modes of TLSOptions (as sslmode of Postgres)
+const (
+	TLSDisable    = "disable"     // Plaintext
+	TLSRequire    = "require"     // Encrypted, the server certificate is not verified
+	TLSVerifyCA   = "verify-ca"   // Encrypted, the server certificate is signed by a trusted CA
+	TLSVerifyFull = "verify-full" // Encrypted, the server certificate is signed by a trusted CA and issued for the server name
+)
+
+// Encryption of the database connection, empty values leave the settings of the URL untouched
+type TLSOptions struct {
+	Mode       string // TLSDisable, TLSRequire, TLSVerifyCA or TLSVerifyFull
+	CAFile     string // PEM file of the trusted CAs, default: system CAs
+	CertFile   string // PEM file of the client certificate
+	KeyFile    string // PEM file of the client key
+	ServerName string // Name in the server certificate, default: host of the URL
+}
+
+func (o TLSOptions) isSet() bool {
+	return o != TLSOptions{}
+}
+
+func (o TLSOptions) validate() error {
+
+	switch o.Mode {
+	case "", TLSDisable, TLSRequire, TLSVerifyCA, TLSVerifyFull:
+	default:
+		return errors.New("invalid TLS mode '" + o.Mode + "' (disable, require, verify-ca or verify-full)")
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("client certificate and key are required together")
+	}
+	return nil
+}
+
+// TLS configuration of drivers that take a *tls.Config (MySQL)
+func (o TLSOptions) config() (*tls.Config, error) {
+
+	var cfg = tls.Config{ServerName: o.ServerName}
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(o.CAFile + ": no PEM certificates found")
+		}
+	}
+
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch o.Mode {
+
+	case TLSRequire:
+		cfg.InsecureSkipVerify = true
+
+	case TLSVerifyCA:
+		// Chain only, the host name is not checked
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, cfg.RootCAs)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// Verifies the certificate chain sent by the server against the trusted CAs (nil: system CAs)
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	var intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Difference between Dialfire and the database
+type Mismatch struct {
+	Type    string   // Entity type
+	ID      string   // $id
+	Kind    string   // MismatchMissing, MismatchExtra or MismatchDivergent
+	Columns []string // Divergent columns
+}
+
+const (
+	MismatchMissing   = "missing"   // Row not in the database
+	MismatchExtra     = "extra"     // Row in the database, but not in Dialfire
+	MismatchDivergent = "divergent" // Values differ
+)
+
+// VerifyContact compares the entities of one contact (contact first, as built by
+// the data splitter) with the rows stored for the contact.
+func (con *DBConnection) VerifyContact(entities []Entity) ([]Mismatch, error) {
+
+	var stored, err = con.storedRows((*entities[0].Data)["$id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []Mismatch
+	for _, entity := range entities {
+
+		if con.Mapping[entity.Type].Exclude {
+			continue
+		}
+
+		var id = fmt.Sprint((*entity.Data)["$id"])
+		var row, exists = stored[entity.Type][id]
+		if !exists {
+			mismatches = append(mismatches, Mismatch{Type: entity.Type, ID: id, Kind: MismatchMissing})
+			continue
+		}
+		delete(stored[entity.Type], id)
+
+		if columns := con.divergentColumns(entity, row); len(columns) > 0 {
+			mismatches = append(mismatches, Mismatch{Type: entity.Type, ID: id, Kind: MismatchDivergent, Columns: columns})
+		}
+	}
+
+	// Rows not produced from the Dialfire data
+	for _, entityType := range con.syncedTypes() {
+
+		var ids []string
+		for id := range stored[entityType] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			mismatches = append(mismatches, Mismatch{Type: entityType, ID: id, Kind: MismatchExtra})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// Repair writes the missing and divergent entities and deletes the extra rows.
+func (con *DBConnection) Repair(entities []Entity, mismatches []Mismatch) error {
+
+	var write = map[string]bool{}
+	var extra []Mismatch
+	for _, m := range mismatches {
+		if m.Kind == MismatchExtra {
+			extra = append(extra, m)
+		} else {
+			write[m.Type+"|"+m.ID] = true
+		}
+	}
+
+	var upserts []Entity
+	for _, entity := range entities {
+		if write[entity.Type+"|"+fmt.Sprint((*entity.Data)["$id"])] {
+			upserts = append(upserts, entity)
+		}
+	}
+
+	if len(upserts) > 0 {
+		if err := con.UpsertAtomic(upserts); err != nil {
+			return err
+		}
+	}
+
+	// Children first
+	for i := len(extra) - 1; i >= 0; i-- {
+		var stmt = "DELETE FROM " + con.qualify(con.tableName(extra[i].Type)) + " WHERE " + con.Dialect.Quote("$id") + " = " + con.Dialect.Placeholder(1)
+		if _, err := con.DB.Exec(stmt, extra[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entity type --> $id --> column --> value of all rows belonging to the contact
+func (con *DBConnection) storedRows(contactID interface{}) (map[string]map[string]map[string]sql.NullString, error) {
+
+	var conditions = con.contactConditions(con.Dialect.Placeholder(1))
+	var result = map[string]map[string]map[string]sql.NullString{}
+
+	for _, entityType := range con.syncedTypes() {
+
+		var stmt = "SELECT * FROM " + con.qualify(con.tableName(entityType)) + " WHERE " + conditions[entityType]
+		rows, err := con.DB.Query(stmt, contactID)
+		if err != nil {
+			return nil, err
+		}
+
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		result[entityType] = map[string]map[string]sql.NullString{}
+		for rows.Next() {
+
+			var values = make([]sql.NullString, len(columns))
+			var dest = make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+
+			if err = rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			var row = map[string]sql.NullString{}
+			for i, column := range columns {
+				row[column] = values[i]
+			}
+			result[entityType][row["$id"].String] = row
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Columns whose stored value differs from the value the entity would be written with
+func (con *DBConnection) divergentColumns(entity Entity, stored map[string]sql.NullString) []string {
+
+	var fieldNames, values = con.row(entity)
+
+	con.schemaMu.RLock()
+	var types = schemaTypes(con.tableSchemas[entity.Type])
+	con.schemaMu.RUnlock()
+
+	var columns []string
+	for i, name := range fieldNames {
+		var family = con.Dialect.TypeFamily(con.toDBType(types[name]))
+		if !sameValue(values[i], stored[name], family) {
+			columns = append(columns, name)
+		}
+	}
+
+	return columns
+}
+
+// Compares a value as returned by row with its stored representation
+func sameValue(expected interface{}, stored sql.NullString, family string) bool {
+
+	if expected == nil || !stored.Valid {
+		return expected == nil && !stored.Valid
+	}
+
+	// JSON documents
+	if document, ok := expected.([]byte); ok {
+		expected = string(document)
+	}
+
+	switch family {
+
+	case "timestamp":
+		t1, ok1 := expected.(time.Time)
+		t2, ok2 := toTimestamp(stored.String).(time.Time)
+		if ok1 && ok2 {
+			return t1.Truncate(time.Millisecond).Equal(t2.Truncate(time.Millisecond))
+		}
+
+	case "numeric":
+		f1, err1 := strconv.ParseFloat(fmt.Sprint(expected), 64)
+		f2, err2 := strconv.ParseFloat(stored.String, 64)
+		if err1 == nil && err2 == nil {
+			return f1 == f2
+		}
+
+	case "json":
+		var v1, v2 interface{}
+		err1 := json.Unmarshal([]byte(fmt.Sprint(expected)), &v1)
+		err2 := json.Unmarshal([]byte(stored.String), &v2)
+		if err1 == nil && err2 == nil {
+			return reflect.DeepEqual(v1, v2)
+		}
+
+	case "bool":
+		b1, err1 := strconv.ParseBool(fmt.Sprint(expected))
+		b2, err2 := strconv.ParseBool(stored.String)
+		if err1 == nil && err2 == nil {
+			return b1 == b2
+		}
+	}
+
+	return fmt.Sprint(expected) == stored.String
+}